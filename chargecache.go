@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/teslamotors/vehicle-command/pkg/protocol/protobuf/carserver"
+	"github.com/teslamotors/vehicle-command/pkg/vehicle"
+)
+
+// chargeStateEntry is one VIN's cached snapshot of ChargeState, refreshed in
+// the background so get_soc/get_charge_state/etc. under wallbox control
+// loops don't each pay for a full BLE handshake.
+type chargeStateEntry struct {
+	mu         sync.RWMutex
+	data       *carserver.ChargeState
+	fetchedAt  time.Time
+	lastAccess time.Time
+}
+
+func (e *chargeStateEntry) fresh(ttl time.Duration) (*carserver.ChargeState, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.lastAccess = time.Now()
+	if e.data == nil || time.Since(e.fetchedAt) > ttl {
+		return nil, false
+	}
+	return e.data, true
+}
+
+func (e *chargeStateEntry) set(data *carserver.ChargeState) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.data = data
+	e.fetchedAt = time.Now()
+}
+
+// idleFor reports how long it has been since the cache was last consulted
+// via fresh, so a poller with no recent readers can stop itself.
+func (e *chargeStateEntry) idleFor() time.Duration {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.lastAccess.IsZero() {
+		return 0
+	}
+	return time.Since(e.lastAccess)
+}
+
+// chargeStatePollerIdleTicks is how many consecutive TTL intervals a VIN's
+// poller will keep refreshing without being read before it stops itself,
+// so a client that stops polling doesn't keep the vehicle awake forever.
+const chargeStatePollerIdleTicks = 3
+
+var chargeStateCache sync.Map   // map[string]*chargeStateEntry
+var chargeStatePollers sync.Map // map[string]struct{}, tracks running pollers
+
+func getChargeStateEntry(vin string) *chargeStateEntry {
+	actual, _ := chargeStateCache.LoadOrStore(vin, &chargeStateEntry{})
+	return actual.(*chargeStateEntry)
+}
+
+// getCachedChargeState returns the cached ChargeState for vin if it is
+// within GetConfig().ChargeStateCacheTTL, and starts the background poller
+// for vin if it isn't already running. Caching is disabled entirely when
+// the TTL is <= 0, in which case every call misses and the caller falls
+// back to a live fetch.
+func getCachedChargeState(vin string) (*carserver.ChargeState, bool) {
+	if GetConfig().ChargeStateCacheTTL <= 0 {
+		return nil, false
+	}
+	ensureChargeStatePoller(vin)
+	return getChargeStateEntry(vin).fresh(GetConfig().ChargeStateCacheTTL)
+}
+
+// ensureChargeStatePoller starts a goroutine that refreshes vin's cached
+// ChargeState every ChargeStateCacheTTL, at most once per VIN. The poller
+// stops itself once the cache has gone chargeStatePollerIdleTicks TTLs
+// without being read, so it doesn't keep polling (and keeping the vehicle
+// awake) after callers stop asking for vin.
+func ensureChargeStatePoller(vin string) {
+	ttl := GetConfig().ChargeStateCacheTTL
+	if ttl <= 0 {
+		return
+	}
+	if _, loaded := chargeStatePollers.LoadOrStore(vin, struct{}{}); loaded {
+		return
+	}
+	go func() {
+		defer chargeStatePollers.Delete(vin)
+		ticker := time.NewTicker(ttl)
+		defer ticker.Stop()
+		idleDeadline := ttl * chargeStatePollerIdleTicks
+		entry := getChargeStateEntry(vin)
+		for range ticker.C {
+			if entry.idleFor() > idleDeadline {
+				log.Printf("charge state poller: stopping idle poller for VIN %s\n", vin)
+				return
+			}
+			refreshChargeState(vin)
+		}
+	}()
+}
+
+// refreshChargeState fetches a live ChargeState over BLE and stores it in
+// the cache, queued behind any other work pending for vin.
+func refreshChargeState(vin string) {
+	if _, err := runQueued(vin, func() (interface{}, error) {
+		data, err := fetchChargeState(vin)
+		if err != nil {
+			return nil, err
+		}
+		getChargeStateEntry(vin).set(data)
+		return nil, nil
+	}); err != nil {
+		log.Printf("charge state poller: failed to refresh VIN %s: %s\n", vin, err)
+	}
+}
+
+func fetchChargeState(vin string) (*carserver.ChargeState, error) {
+	car, conn, err := prepareConnection(vin, "get_charge_state")
+	if err != nil {
+		return nil, fmt.Errorf("could not prepare vehicle connection: %s", err)
+	}
+	defer conn.Close()
+	defer car.Disconnect()
+	if sessionCache != nil {
+		defer car.UpdateCachedSessions(sessionCache)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	data, err := car.GetState(ctx, vehicle.StateCategoryCharge)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get state: %s", err)
+	}
+	return data.GetChargeState(), nil
+}
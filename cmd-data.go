@@ -6,19 +6,58 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/teslamotors/vehicle-command/pkg/protocol/protobuf/carserver"
 	"github.com/teslamotors/vehicle-command/pkg/vehicle"
 )
 
 type getDataFunction func(*vehicle.Vehicle) (interface{}, error)
 
-var dataCommands = map[string]getDataFunction{
-	"get_soc":           getSoc,
-	"get_soc_limit":     getLimitSoc,
-	"get_battery_range": getBatteryRange,
-	"get_charge_state":  getChargeState,
+var dataCommandsMu sync.RWMutex
+var dataCommands = map[string]getDataFunction{}
+
+// RegisterDataCommand adds or overrides a read-only command served under
+// GET /api/1/vehicles/{vin}/data/{name}. Call it from an init() in your own
+// package to expose custom accessors without forking this module.
+func RegisterDataCommand(name string, fn func(*vehicle.Vehicle) (interface{}, error)) {
+	dataCommandsMu.Lock()
+	defer dataCommandsMu.Unlock()
+	dataCommands[name] = fn
+}
+
+func lookupDataCommand(name string) (getDataFunction, bool) {
+	dataCommandsMu.RLock()
+	defer dataCommandsMu.RUnlock()
+	fn, ok := dataCommands[name]
+	return fn, ok
+}
+
+func init() {
+	RegisterDataCommand("get_soc", getSoc)
+	RegisterDataCommand("get_soc_limit", getLimitSoc)
+	RegisterDataCommand("get_battery_range", getBatteryRange)
+	RegisterDataCommand("get_charge_state", getChargeState)
+	RegisterDataCommand("get_charge_current_actual", getChargeCurrentActual)
+	RegisterDataCommand("get_climate_state", getClimateState)
+	RegisterDataCommand("get_vehicle_state", getVehicleState)
+	RegisterDataCommand("get_drive_state", getDriveState)
+	RegisterDataCommand("get_tire_pressures", getTirePressures)
+	RegisterDataCommand("get_software_state", getSoftwareState)
+	RegisterDataCommand("get_all", getAll)
+}
+
+// chargeStateCommands are the commands backed by vehicle.StateCategoryCharge
+// and thus servable from the cached ChargeState maintained by
+// chargecache.go instead of always opening a fresh BLE session.
+var chargeStateCommands = map[string]func(*carserver.ChargeState) (interface{}, error){
+	"get_soc":                   socFromChargeState,
+	"get_soc_limit":             limitSocFromChargeState,
+	"get_battery_range":         batteryRangeFromChargeState,
+	"get_charge_state":          chargeStateFromChargeState,
+	"get_charge_current_actual": chargeCurrentActualFromChargeState,
 }
 
 func handleGetDataCommand(w http.ResponseWriter, r *http.Request) {
@@ -31,7 +70,23 @@ func handleGetDataCommand(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	res, err := execDataCommand(vin, command)
+	fresh := r.URL.Query().Get("fresh") == "1"
+
+	ctx := r.Context()
+	work := func() (interface{}, error) {
+		return execDataCommand(ctx, vin, command, fresh)
+	}
+
+	if r.URL.Query().Get("async") == "true" {
+		job := submitJob(vin, work)
+		jobID := newJobID()
+		jobStore.Store(jobID, job)
+		w.WriteHeader(http.StatusAccepted)
+		sendJSON(w, map[string]string{"job_id": jobID})
+		return
+	}
+
+	res, err := runQueued(vin, work)
 	if err != nil {
 		if errors.Is(err, errCmdNotFound) {
 			http.Error(w, "Not Found", http.StatusNotFound)
@@ -44,13 +99,23 @@ func handleGetDataCommand(w http.ResponseWriter, r *http.Request) {
 	sendJSON(w, res)
 }
 
-func execDataCommand(vin string, command string) (interface{}, error) {
-	cmdFunc, ok := dataCommands[command]
+func execDataCommand(ctx context.Context, vin string, command string, fresh bool) (interface{}, error) {
+	if GetConfig().RelayMode == "controller" {
+		return relayExecDataCommand(vin, command)
+	}
+
+	cmdFunc, ok := lookupDataCommand(command)
 	if !ok {
 		return nil, errCmdNotFound
 	}
 
-	log.Printf("Executing get data command %s for VIN %s ...\n", command, vin)
+	if !fresh {
+		if extract, ok := chargeStateCommands[command]; ok {
+			if cached, ok := getCachedChargeState(vin); ok {
+				return extract(cached)
+			}
+		}
+	}
 
 	car, conn, err := prepareConnection(vin, command)
 	if err != nil {
@@ -58,61 +123,295 @@ func execDataCommand(vin string, command string) (interface{}, error) {
 	}
 	defer conn.Close()
 	defer car.Disconnect()
+	if sessionCache != nil {
+		defer car.UpdateCachedSessions(sessionCache)
+	}
 
+	start := time.Now()
 	res, err := cmdFunc(car)
+	duration := time.Since(start)
+	logCommand(ctx, vin, command, 1, duration, err)
+	metricCommandDuration.WithLabelValues(command).Observe(duration.Seconds())
 	if err != nil {
+		metricCommandsTotal.WithLabelValues(vin, command, "error").Inc()
 		return nil, fmt.Errorf("could not get data: %s", err)
 	}
+	metricCommandsTotal.WithLabelValues(vin, command, "success").Inc()
 	return res, nil
 }
 
-func getSoc(car *vehicle.Vehicle) (interface{}, error) {
+// fetchChargeStateCategory is the shared BLE fetch behind every data
+// function that only needs vehicle.StateCategoryCharge, so each one stays a
+// one-line call into the corresponding *FromChargeState extractor.
+func fetchChargeStateCategory(car *vehicle.Vehicle) (*carserver.ChargeState, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	data, err := car.GetState(ctx, vehicle.StateCategoryCharge)
 	if err != nil {
-		return 0, fmt.Errorf("failed to get state: %s", err)
+		return nil, fmt.Errorf("failed to get state: %s", err)
 	}
-	return data.GetChargeState().GetBatteryLevel(), nil
+	return data.GetChargeState(), nil
+}
+
+func socFromChargeState(cs *carserver.ChargeState) (interface{}, error) {
+	return cs.GetBatteryLevel(), nil
+}
+
+func getSoc(car *vehicle.Vehicle) (interface{}, error) {
+	cs, err := fetchChargeStateCategory(car)
+	if err != nil {
+		return 0, err
+	}
+	return socFromChargeState(cs)
+}
+
+func limitSocFromChargeState(cs *carserver.ChargeState) (interface{}, error) {
+	return cs.GetChargeLimitSoc(), nil
 }
 
 func getLimitSoc(car *vehicle.Vehicle) (interface{}, error) {
+	cs, err := fetchChargeStateCategory(car)
+	if err != nil {
+		return 0, err
+	}
+	return limitSocFromChargeState(cs)
+}
+
+func batteryRangeFromChargeState(cs *carserver.ChargeState) (interface{}, error) {
+	return cs.GetBatteryRange(), nil
+}
+
+func getBatteryRange(car *vehicle.Vehicle) (interface{}, error) {
+	cs, err := fetchChargeStateCategory(car)
+	if err != nil {
+		return 0, err
+	}
+	return batteryRangeFromChargeState(cs)
+}
+
+// chargeStateFromChargeState derives the IEC 61851 pilot state (A/B/C) the
+// vehicle is currently in from its raw ChargingState, so wallbox
+// integrations can drive PWM duty cycle off the same value evcc/openWB
+// expect:
+//   - A: no vehicle connected
+//   - B: vehicle connected, not drawing current
+//   - C: vehicle connected and charging
+func chargeStateFromChargeState(cs *carserver.ChargeState) (interface{}, error) {
+	state := cs.GetChargingState()
+	if state.GetDisconnected() != nil {
+		return "A", nil
+	}
+	if state.GetCharging() != nil || state.GetStarting() != nil {
+		return "C", nil
+	}
+	if state.GetStopped() != nil || state.GetNoPower() != nil || state.GetComplete() != nil || state.GetCalibrating() != nil {
+		return "B", nil
+	}
+	return "A", nil
+}
+
+func getChargeState(car *vehicle.Vehicle) (interface{}, error) {
+	cs, err := fetchChargeStateCategory(car)
+	if err != nil {
+		return "A", err
+	}
+	return chargeStateFromChargeState(cs)
+}
+
+func chargeCurrentActualFromChargeState(cs *carserver.ChargeState) (interface{}, error) {
+	return cs.GetChargerActualCurrent(), nil
+}
+
+// getChargeCurrentActual returns the measured line current in amps, so a
+// wallbox's PWM adjustment loop can react to what the vehicle is actually
+// drawing instead of only the requested charging_amps.
+func getChargeCurrentActual(car *vehicle.Vehicle) (interface{}, error) {
+	cs, err := fetchChargeStateCategory(car)
+	if err != nil {
+		return 0, err
+	}
+	return chargeCurrentActualFromChargeState(cs)
+}
+
+// climateStateJSON is a JSON-friendly subset of carserver.ClimateState.
+type climateStateJSON struct {
+	InsideTempC       float32 `json:"inside_temp_c"`
+	OutsideTempC      float32 `json:"outside_temp_c"`
+	IsClimateOn       bool    `json:"is_climate_on"`
+	IsPreconditioning bool    `json:"is_preconditioning"`
+}
+
+func getClimateState(car *vehicle.Vehicle) (interface{}, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	data, err := car.GetState(ctx, vehicle.StateCategoryCharge)
+	data, err := car.GetState(ctx, vehicle.StateCategoryClimate)
 	if err != nil {
-		return 0, fmt.Errorf("failed to get state: %s", err)
+		return nil, fmt.Errorf("failed to get state: %s", err)
 	}
-	return data.GetChargeState().GetChargeLimitSoc(), nil
+	state := data.GetClimateState()
+	return climateStateJSON{
+		InsideTempC:       state.GetInsideTempCelsius(),
+		OutsideTempC:      state.GetOutsideTempCelsius(),
+		IsClimateOn:       state.GetIsClimateOn(),
+		IsPreconditioning: state.GetIsPreconditioning(),
+	}, nil
 }
 
-func getBatteryRange(car *vehicle.Vehicle) (interface{}, error) {
+// vehicleStateJSON is a JSON-friendly subset of carserver.ClosuresState,
+// covering doors, windows, frunk/trunk and lock status.
+type vehicleStateJSON struct {
+	Locked               bool `json:"locked"`
+	DoorDriverFront      bool `json:"door_driver_front"`
+	DoorDriverRear       bool `json:"door_driver_rear"`
+	DoorPassengerFront   bool `json:"door_passenger_front"`
+	DoorPassengerRear    bool `json:"door_passenger_rear"`
+	FrunkOpen            bool `json:"frunk_open"`
+	TrunkOpen            bool `json:"trunk_open"`
+	WindowDriverFront    bool `json:"window_driver_front"`
+	WindowPassengerFront bool `json:"window_passenger_front"`
+	WindowDriverRear     bool `json:"window_driver_rear"`
+	WindowPassengerRear  bool `json:"window_passenger_rear"`
+}
+
+func getVehicleState(car *vehicle.Vehicle) (interface{}, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	data, err := car.GetState(ctx, vehicle.StateCategoryCharge)
+	data, err := car.GetState(ctx, vehicle.StateCategoryClosures)
 	if err != nil {
-		return 0, fmt.Errorf("failed to get state: %s", err)
+		return nil, fmt.Errorf("failed to get state: %s", err)
 	}
-	return data.GetChargeState().GetBatteryRange(), nil
+	state := data.GetClosuresState()
+	return vehicleStateJSON{
+		Locked:               state.GetLocked(),
+		DoorDriverFront:      state.GetDoorOpenDriverFront(),
+		DoorDriverRear:       state.GetDoorOpenDriverRear(),
+		DoorPassengerFront:   state.GetDoorOpenPassengerFront(),
+		DoorPassengerRear:    state.GetDoorOpenPassengerRear(),
+		FrunkOpen:            state.GetDoorOpenTrunkFront(),
+		TrunkOpen:            state.GetDoorOpenTrunkRear(),
+		WindowDriverFront:    state.GetWindowOpenDriverFront(),
+		WindowPassengerFront: state.GetWindowOpenPassengerFront(),
+		WindowDriverRear:     state.GetWindowOpenDriverRear(),
+		WindowPassengerRear:  state.GetWindowOpenPassengerRear(),
+	}, nil
 }
 
-func getChargeState(car *vehicle.Vehicle) (interface{}, error) {
+// driveStateJSON is a JSON-friendly subset of carserver.DriveState.
+type driveStateJSON struct {
+	ShiftState string  `json:"shift_state"`
+	SpeedMph   uint32  `json:"speed_mph"`
+	OdometerMi float32 `json:"odometer_mi"`
+}
+
+func shiftStateToString(state *carserver.ShiftState) string {
+	switch state.GetType().(type) {
+	case *carserver.ShiftState_P:
+		return "P"
+	case *carserver.ShiftState_R:
+		return "R"
+	case *carserver.ShiftState_N:
+		return "N"
+	case *carserver.ShiftState_D:
+		return "D"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+func getDriveState(car *vehicle.Vehicle) (interface{}, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	data, err := car.GetState(ctx, vehicle.StateCategoryCharge)
+	data, err := car.GetState(ctx, vehicle.StateCategoryDrive)
 	if err != nil {
-		return "A", fmt.Errorf("failed to get state: %s", err)
+		return nil, fmt.Errorf("failed to get state: %s", err)
 	}
-	state := data.GetChargeState().GetChargingState()
-	if state.GetCharging() != nil {
-		return "C", nil
+	state := data.GetDriveState()
+	return driveStateJSON{
+		ShiftState: shiftStateToString(state.GetShiftState()),
+		SpeedMph:   state.GetSpeed(),
+		OdometerMi: float32(state.GetOdometerInHundredthsOfAMile()) / 100,
+	}, nil
+}
+
+// tirePressuresJSON is a JSON-friendly subset of carserver.TirePressureState.
+type tirePressuresJSON struct {
+	FrontLeft  float32 `json:"front_left"`
+	FrontRight float32 `json:"front_right"`
+	RearLeft   float32 `json:"rear_left"`
+	RearRight  float32 `json:"rear_right"`
+}
+
+func getTirePressures(car *vehicle.Vehicle) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	data, err := car.GetState(ctx, vehicle.StateCategoryTirePressure)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get state: %s", err)
 	}
-	if state.GetStopped() != nil || state.GetNoPower() != nil || state.GetComplete() != nil {
-		return "B", nil
+	state := data.GetTirePressureState()
+	return tirePressuresJSON{
+		FrontLeft:  state.GetTpmsPressureFl(),
+		FrontRight: state.GetTpmsPressureFr(),
+		RearLeft:   state.GetTpmsPressureRl(),
+		RearRight:  state.GetTpmsPressureRr(),
+	}, nil
+}
+
+// softwareStateJSON is a JSON-friendly subset of carserver.SoftwareUpdateState.
+type softwareStateJSON struct {
+	Version         string `json:"version"`
+	UpdateAvailable bool   `json:"update_available"`
+}
+
+func getSoftwareState(car *vehicle.Vehicle) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	data, err := car.GetState(ctx, vehicle.StateCategorySoftwareUpdate)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get state: %s", err)
 	}
-	return "A", nil
+	state := data.GetSoftwareUpdateState()
+	return softwareStateJSON{
+		Version:         state.GetVersion(),
+		UpdateAvailable: state.GetStatus().GetAvailable() != nil,
+	}, nil
+}
+
+// getAllCommands lists the data commands getAll fans out to. Kept
+// separate from dataCommands to avoid an initialization cycle between
+// the two.
+var getAllCommands = map[string]getDataFunction{
+	"get_soc":            getSoc,
+	"get_soc_limit":      getLimitSoc,
+	"get_battery_range":  getBatteryRange,
+	"get_charge_state":   getChargeState,
+	"get_climate_state":  getClimateState,
+	"get_vehicle_state":  getVehicleState,
+	"get_drive_state":    getDriveState,
+	"get_tire_pressures": getTirePressures,
+	"get_software_state": getSoftwareState,
+}
+
+// getAll runs every data command in turn against car and returns a single
+// merged JSON object, so consumers like Home Assistant can get a full
+// snapshot from one BLE session. The vehicle only supports one command at
+// a time over its BLE connection (see queue.go), so these run
+// sequentially rather than fanned out concurrently.
+func getAll(car *vehicle.Vehicle) (interface{}, error) {
+	merged := make(map[string]interface{})
+	for name, fn := range getAllCommands {
+		data, err := fn(car)
+		if err != nil {
+			log.Printf("get_all: failed to fetch %s: %s\n", name, err)
+			continue
+		}
+		merged[name] = data
+	}
+	return merged, nil
 }
@@ -8,24 +8,24 @@ import (
 	"log"
 	"net/http"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
-	"github.com/teslamotors/vehicle-command/pkg/protocol/protobuf/vcsec"
 	"github.com/teslamotors/vehicle-command/pkg/vehicle"
+	"github.com/virtualzone/tesla-ble/pkg/action"
 )
 
-type cmdFunction func(*vehicle.Vehicle, map[string]interface{}) error
-
-var commands = map[string]cmdFunction{
-	"pair":              cmdPairVehicle,
-	"wake_up":           cmdWakeUp,
-	"set_charging_amps": cmdSetChargingAmps,
-	"set_soc_limit":     cmdSetSocLimit,
-	"charge":            cmdChargeEnable,
-	"charge_start":      cmdChargeStart,
-	"charge_stop":       cmdChargeStop,
+// actionBuilder decodes an HTTP command body into a typed Action.
+type actionBuilder func(body map[string]interface{}) (action.Action, error)
+
+var commands = map[string]actionBuilder{
+	"pair":              buildPairAction,
+	"wake_up":           buildWakeUpAction,
+	"set_charging_amps": buildSetChargingAmpsAction,
+	"set_soc_limit":     buildSetSocLimitAction,
+	"charge":            buildChargeEnableAction,
+	"charge_start":      buildChargeStartAction,
+	"charge_stop":       buildChargeStopAction,
 }
 
 func handleExecCommand(w http.ResponseWriter, r *http.Request) {
@@ -45,16 +45,30 @@ func handleExecCommand(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if needWakeUp(command) {
-		if err := execCommand(vin, "wake_up", body); err != nil {
-			log.Printf("Waking vehicle failed, giving up: %s\n", err)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			return
+	ctx := r.Context()
+	work := func() (interface{}, error) {
+		if needWakeUp(command) {
+			if err := execCommand(ctx, vin, "wake_up", body); err != nil {
+				return nil, fmt.Errorf("waking vehicle failed, giving up: %s", err)
+			}
+			time.Sleep(5 * time.Second)
 		}
-		time.Sleep(5 * time.Second)
+		if err := execCommand(ctx, vin, command, body); err != nil {
+			return nil, err
+		}
+		return true, nil
 	}
 
-	if err := execCommand(vin, command, body); err != nil {
+	if r.URL.Query().Get("async") == "true" {
+		job := submitJob(vin, work)
+		jobID := newJobID()
+		jobStore.Store(jobID, job)
+		w.WriteHeader(http.StatusAccepted)
+		sendJSON(w, map[string]string{"job_id": jobID})
+		return
+	}
+
+	if _, err := runQueued(vin, work); err != nil {
 		if errors.Is(err, errCmdNotFound) {
 			http.Error(w, "Not Found", http.StatusNotFound)
 			return
@@ -66,13 +80,19 @@ func handleExecCommand(w http.ResponseWriter, r *http.Request) {
 	sendJSON(w, true)
 }
 
-func execCommand(vin string, command string, body map[string]interface{}) error {
-	cmdFunc, ok := commands[command]
+func execCommand(ctx context.Context, vin string, command string, body map[string]interface{}) error {
+	if GetConfig().RelayMode == "controller" {
+		return relayExecCommand(vin, command, body)
+	}
+
+	build, ok := commands[command]
 	if !ok {
 		return errCmdNotFound
 	}
-
-	log.Printf("Executing command %s for VIN %s ...\n", command, vin)
+	act, err := build(body)
+	if err != nil {
+		return fmt.Errorf("failed to build command %s: %s", command, err)
+	}
 
 	car, conn, err := prepareConnection(vin, command)
 	if err != nil {
@@ -80,126 +100,113 @@ func execCommand(vin string, command string, body map[string]interface{}) error
 	}
 	defer conn.Close()
 	defer car.Disconnect()
+	if sessionCache != nil {
+		defer car.UpdateCachedSessions(sessionCache)
+	}
 
-	if err := retryCommand(vin, command, car, cmdFunc, body); err != nil {
+	if err := retryCommand(ctx, vin, act, car); err != nil {
 		return fmt.Errorf("retrying command %s failed: %s", command, err)
 	}
 	return nil
 }
 
-func retryCommand(vin string, command string, car *vehicle.Vehicle, cmdFunc cmdFunction, body map[string]interface{}) error {
+func retryCommand(ctx context.Context, vin string, act action.Action, car *vehicle.Vehicle) error {
 	tries := 1
 	for tries <= 3 {
-		if tries > 1 {
-			log.Printf("Retry %d of command %s for VIN %s ...\n", tries, command, vin)
-		}
-		if err := cmdFunc(car, body); err != nil {
-			log.Printf("Failed to process command %s: %s\n", command, err)
+		start := time.Now()
+		execCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err := act.Execute(execCtx, car)
+		cancel()
+		duration := time.Since(start)
+
+		logCommand(ctx, vin, act.Name(), tries, duration, err)
+		metricCommandDuration.WithLabelValues(act.Name()).Observe(duration.Seconds())
+		if err != nil {
+			metricCommandsTotal.WithLabelValues(vin, act.Name(), "error").Inc()
 			tries++
 		} else {
-			log.Printf("Successfully processed command %s\n", command)
+			metricCommandsTotal.WithLabelValues(vin, act.Name(), "success").Inc()
 			return nil
 		}
 	}
-	log.Printf("Giving up on command %s for VIN %s after too many reties\n", command, vin)
-	return errors.New("too many retries")
+	return fmt.Errorf("too many retries of command %s for VIN %s", act.Name(), vin)
 }
 
-func cmdPairVehicle(car *vehicle.Vehicle, body map[string]interface{}) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-
-	if err := car.SendAddKeyRequest(ctx, GetConfig().PublicKey, true, vcsec.KeyFormFactor_KEY_FORM_FACTOR_UNKNOWN); err != nil {
-		return fmt.Errorf("failed to send add key request: %s", err)
-	}
-	return nil
-}
-
-func cmdWakeUp(car *vehicle.Vehicle, body map[string]interface{}) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-
-	if err := car.Wakeup(ctx); err != nil {
-		return fmt.Errorf("failed to wake up vehicle: %s", err)
+// numberFromBody extracts a numeric field that may be encoded as either a
+// JSON number or a numeric string, for backward compatibility with
+// existing API clients.
+func numberFromBody(body map[string]interface{}, field string) (int32, error) {
+	raw, ok := body[field]
+	if !ok {
+		return 0, fmt.Errorf("failed to find %s in request body", field)
+	}
+	switch v := raw.(type) {
+	case float64:
+		return int32(v), nil
+	case string:
+		n, err := strconv.ParseInt(v, 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("failed to parse %s to int: %s", field, err)
+		}
+		return int32(n), nil
+	default:
+		return 0, fmt.Errorf("failed to parse %s to int", field)
 	}
-	return nil
 }
 
-func cmdSetChargingAmps(car *vehicle.Vehicle, body map[string]interface{}) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-
-	chargingAmpsString, ok := body["charging_amps"].(string)
+// boolFromBody extracts a boolean field that may be encoded as either a
+// JSON bool or the strings "true"/"false", for backward compatibility.
+func boolFromBody(body map[string]interface{}, field string) (bool, error) {
+	raw, ok := body[field]
 	if !ok {
-		return fmt.Errorf("failed to find charging_amps in request body")
+		return false, fmt.Errorf("failed to find %s in request body", field)
 	}
-
-	chargingAmps, err := strconv.ParseInt(chargingAmpsString, 10, 32)
-	if err != nil {
-		return fmt.Errorf("failed to parse charging_amps to int: %s", err)
+	switch v := raw.(type) {
+	case bool:
+		return v, nil
+	case string:
+		return v == "true", nil
+	default:
+		return false, fmt.Errorf("failed to parse %s to bool", field)
 	}
-
-	if err := car.SetChargingAmps(ctx, int32(chargingAmps)); err != nil {
-		return fmt.Errorf("failed to set charging amps: %s", err)
-	}
-	return nil
 }
 
-func cmdSetSocLimit(car *vehicle.Vehicle, body map[string]interface{}) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
+func buildPairAction(body map[string]interface{}) (action.Action, error) {
+	return action.Pair(GetConfig().PublicKey), nil
+}
 
-	socLimitString, ok := body["soc_limit"].(string)
-	if !ok {
-		return fmt.Errorf("failed to find soc_limit in request body")
-	}
+func buildWakeUpAction(body map[string]interface{}) (action.Action, error) {
+	return action.WakeUp(), nil
+}
 
-	socLimit, err := strconv.ParseInt(socLimitString, 10, 32)
+func buildSetChargingAmpsAction(body map[string]interface{}) (action.Action, error) {
+	amps, err := numberFromBody(body, "charging_amps")
 	if err != nil {
-		return fmt.Errorf("failed to parse soc_limit to int: %s", err)
-	}
-
-	if err := car.ChangeChargeLimit(ctx, int32(socLimit)); err != nil {
-		return fmt.Errorf("failed to set soc limit: %s", err)
+		return nil, err
 	}
-	return nil
+	return action.SetChargingAmps(amps), nil
 }
 
-func cmdChargeEnable(car *vehicle.Vehicle, body map[string]interface{}) error {
-	enable, ok := body["enable"].(string)
-	if !ok {
-		return fmt.Errorf("failed to find enable in request body")
-	}
-
-	if enable == "true" {
-		return cmdChargeStart(car, body)
-	} else {
-		return cmdChargeStop(car, body)
+func buildSetSocLimitAction(body map[string]interface{}) (action.Action, error) {
+	limit, err := numberFromBody(body, "soc_limit")
+	if err != nil {
+		return nil, err
 	}
+	return action.ChangeChargeLimit(limit), nil
 }
 
-func cmdChargeStart(car *vehicle.Vehicle, body map[string]interface{}) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-
-	if err := car.ChargeStart(ctx); err != nil {
-		if strings.Contains(err.Error(), "already_started") || strings.Contains(err.Error(), "is_charging") {
-			return nil
-		}
-		return fmt.Errorf("failed to start charging: %s", err)
+func buildChargeEnableAction(body map[string]interface{}) (action.Action, error) {
+	enable, err := boolFromBody(body, "enable")
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	return action.ChargeEnable(enable), nil
 }
 
-func cmdChargeStop(car *vehicle.Vehicle, body map[string]interface{}) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
+func buildChargeStartAction(body map[string]interface{}) (action.Action, error) {
+	return action.ChargeStart(), nil
+}
 
-	if err := car.ChargeStop(ctx); err != nil {
-		if strings.Contains(err.Error(), "not_charging") {
-			return nil
-		}
-		return fmt.Errorf("failed to stop charging: %s", err)
-	}
-	return nil
+func buildChargeStopAction(body map[string]interface{}) (action.Action, error) {
+	return action.ChargeStop(), nil
 }
@@ -7,16 +7,37 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/teslamotors/vehicle-command/pkg/protocol"
 )
 
 type Config struct {
-	Port       int
-	PrivateKey protocol.ECDHPrivateKey
-	PublicKey  *ecdh.PublicKey
-	Username   string
-	Password   string
+	Port        int
+	PrivateKey  protocol.ECDHPrivateKey
+	PublicKey   *ecdh.PublicKey
+	Username    string
+	Password    string
+	RelayMode   string // "", "agent" or "controller"
+	RelayURL    string // controller WebSocket URL the agent dials
+	RelaySecret string // shared secret used for the agent registration handshake
+	RelayVIN    string // VIN this agent serves
+
+	SessionCachePath string // file sessions are persisted to, disabled if empty
+
+	MQTTBroker       string // e.g. tcp://localhost:1883 or ssl://localhost:8883, disabled if empty
+	MQTTUsername     string
+	MQTTPassword     string
+	MQTTTopicPrefix  string
+	MQTTVINs         []string // VINs to poll and publish state for
+	MQTTPollInterval time.Duration
+
+	MQTTCACert                string // PEM file to verify the broker's certificate against, uses the system pool if empty
+	MQTTClientCert            string // PEM file for TLS client certificate authentication, disabled if empty
+	MQTTClientKey             string // PEM file matching MQTTClientCert
+	MQTTTLSInsecureSkipVerify bool
+
+	ChargeStateCacheTTL time.Duration // how long a polled ChargeState may be served from cache
 }
 
 var _configInstance *Config
@@ -45,7 +66,8 @@ func (c *Config) ReadConfig() {
 		log.Panicln("Need to specify PRIVATE_KEY")
 	}
 	if strings.Index(privateKeyFile, "http://") == 0 || strings.Index(privateKeyFile, "https://") == 0 {
-		if err := GetCacheHttpFile(privateKeyFile, "/tmp/private.pem"); err != nil {
+		privateKeySHA256 := c.getEnv("PRIVATE_KEY_SHA256", "")
+		if err := GetCacheHttpFileVerified(privateKeyFile, "/tmp/private.pem", privateKeySHA256); err != nil {
 			log.Panicf("Could not load private key file via http: %s\n", err.Error())
 		}
 		privateKeyFile = "/tmp/private.pem"
@@ -61,7 +83,8 @@ func (c *Config) ReadConfig() {
 		log.Panicln("Need to specify PUBLIC_KEY")
 	}
 	if strings.Index(publicKeyFile, "http://") == 0 || strings.Index(publicKeyFile, "https://") == 0 {
-		if err := GetCacheHttpFile(publicKeyFile, "/tmp/public.pem"); err != nil {
+		publicKeySHA256 := c.getEnv("PUBLIC_KEY_SHA256", "")
+		if err := GetCacheHttpFileVerified(publicKeyFile, "/tmp/public.pem", publicKeySHA256); err != nil {
 			log.Panicf("Could not load public key file via http: %s\n", err.Error())
 		}
 		publicKeyFile = "/tmp/public.pem"
@@ -71,6 +94,49 @@ func (c *Config) ReadConfig() {
 		log.Panicf("Could not load public key: %s\n", err.Error())
 	}
 	c.PublicKey = publicKey
+
+	c.RelayMode = c.getEnv("RELAY_MODE", "")
+	c.RelayURL = c.getEnv("RELAY_URL", "")
+	c.RelaySecret = c.getEnv("RELAY_SECRET", "")
+	c.RelayVIN = c.getEnv("RELAY_VIN", "")
+	if c.RelayMode == "agent" && (c.RelayURL == "" || c.RelayVIN == "") {
+		log.Panicln("RELAY_MODE=agent requires RELAY_URL and RELAY_VIN to be set")
+	}
+	if (c.RelayMode == "agent" || c.RelayMode == "controller") && c.RelaySecret == "" {
+		log.Panicln("RELAY_MODE=agent/controller requires RELAY_SECRET to be set")
+	}
+
+	c.SessionCachePath = c.getEnv("SESSION_CACHE", "/var/lib/tesla-ble/sessions.json")
+
+	c.MQTTBroker = c.getEnv("MQTT_BROKER", "")
+	c.MQTTUsername = c.getEnv("MQTT_USERNAME", "")
+	c.MQTTPassword = c.getEnv("MQTT_PASSWORD", "")
+	c.MQTTTopicPrefix = c.getEnv("MQTT_TOPIC_PREFIX", "tesla-ble")
+	if vins := c.getEnv("MQTT_VINS", ""); vins != "" {
+		c.MQTTVINs = strings.Split(vins, ",")
+	}
+	pollSeconds, err := strconv.Atoi(c.getEnv("MQTT_POLL_INTERVAL_SECONDS", "60"))
+	if err != nil {
+		log.Panicln("MQTT_POLL_INTERVAL_SECONDS must be numeric")
+	}
+	c.MQTTPollInterval = time.Duration(pollSeconds) * time.Second
+	if c.MQTTBroker != "" && len(c.MQTTVINs) == 0 {
+		log.Panicln("MQTT_BROKER requires MQTT_VINS to be set")
+	}
+
+	c.MQTTCACert = c.getEnv("MQTT_CA_CERT", "")
+	c.MQTTClientCert = c.getEnv("MQTT_CLIENT_CERT", "")
+	c.MQTTClientKey = c.getEnv("MQTT_CLIENT_KEY", "")
+	c.MQTTTLSInsecureSkipVerify = c.getEnv("MQTT_TLS_INSECURE_SKIP_VERIFY", "false") == "true"
+	if (c.MQTTClientCert == "") != (c.MQTTClientKey == "") {
+		log.Panicln("MQTT_CLIENT_CERT and MQTT_CLIENT_KEY must be set together")
+	}
+
+	cacheTTLSeconds, err := strconv.Atoi(c.getEnv("CHARGE_STATE_CACHE_TTL_SECONDS", "5"))
+	if err != nil {
+		log.Panicln("CHARGE_STATE_CACHE_TTL_SECONDS must be numeric")
+	}
+	c.ChargeStateCacheTTL = time.Duration(cacheTTLSeconds) * time.Second
 }
 
 func (c *Config) getEnv(key, defaultValue string) string {
@@ -1,22 +1,224 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
-func GetCacheHttpFile(url string, localFile string) error {
-	resp, err := http.Get(url)
+// fetchMeta is persisted alongside each cached file so a later Fetch can
+// issue a conditional GET instead of re-downloading unchanged content.
+type fetchMeta struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// Fetcher downloads and caches remote files: it streams to a temp file and
+// renames it into place so a crash mid-download never leaves a truncated
+// file behind, retries transient failures with exponential backoff, and
+// skips the download entirely when a conditional GET comes back 304.
+type Fetcher struct {
+	// Client is used to perform requests. Defaults to http.DefaultClient
+	// when nil; tests can inject one with a short timeout.
+	Client *http.Client
+	// MaxRetries is the number of attempts made before giving up. Defaults
+	// to 3 when <= 0.
+	MaxRetries int
+	// RetryDelay is the backoff before the first retry, doubled after each
+	// subsequent attempt. Defaults to 1s when <= 0.
+	RetryDelay time.Duration
+	// VerifySHA256, if set, is the expected hex-encoded SHA-256 of the
+	// downloaded body. A mismatch fails the fetch before the file is
+	// trusted, so pinned cert bundles can't be silently swapped out.
+	VerifySHA256 string
+}
+
+// NewFetcher returns a Fetcher with the module's default timeout and retry
+// policy.
+func NewFetcher() *Fetcher {
+	return &Fetcher{
+		Client:     &http.Client{Timeout: 30 * time.Second},
+		MaxRetries: 3,
+		RetryDelay: time.Second,
+	}
+}
+
+func (f *Fetcher) client() *http.Client {
+	if f.Client != nil {
+		return f.Client
+	}
+	return http.DefaultClient
+}
+
+func metaPath(localFile string) string {
+	return localFile + ".meta.json"
+}
+
+func (f *Fetcher) loadMeta(localFile string) fetchMeta {
+	var meta fetchMeta
+	data, err := os.ReadFile(metaPath(localFile))
+	if err != nil {
+		return meta
+	}
+	_ = json.Unmarshal(data, &meta)
+	return meta
+}
+
+func (f *Fetcher) saveMeta(localFile string, meta fetchMeta) error {
+	data, err := json.Marshal(meta)
 	if err != nil {
 		return err
 	}
-	resBody, err := io.ReadAll(resp.Body)
+	return os.WriteFile(metaPath(localFile), data, 0644)
+}
+
+// Fetch downloads url to localFile, reusing the cached copy (and its
+// sidecar metadata) across calls via conditional requests. A 304 response
+// is treated as success and leaves localFile untouched.
+func (f *Fetcher) Fetch(url string, localFile string) error {
+	meta := f.loadMeta(localFile)
+
+	maxRetries := f.MaxRetries
+	if maxRetries <= 0 {
+		maxRetries = 3
+	}
+	delay := f.RetryDelay
+	if delay <= 0 {
+		delay = time.Second
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < maxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		retryable, err := f.fetchOnce(url, localFile, meta)
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+		if !retryable {
+			break
+		}
+	}
+	return fmt.Errorf("failed to fetch %s: %s", url, lastErr)
+}
+
+// fetchOnce performs a single attempt and reports whether the failure (if
+// any) is worth retrying, e.g. a network error or a 5xx is, a 4xx isn't.
+func (f *Fetcher) fetchOnce(url string, localFile string, meta fetchMeta) (retryable bool, err error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return false, err
+	}
+	// Only send conditional headers if localFile is actually still there;
+	// otherwise a 304 would leave us reporting success for a file we never
+	// wrote, e.g. after it was removed out from under a stale sidecar. And
+	// never send them at all when a hash is pinned: a 304 trusts whatever
+	// is already on disk without ever checking it against VerifySHA256, so
+	// a file cached before pinning was turned on (or under a different
+	// pinned hash) would otherwise be "verified" without the hash ever
+	// being checked.
+	if f.VerifySHA256 == "" {
+		if _, statErr := os.Stat(localFile); statErr == nil {
+			if meta.ETag != "" {
+				req.Header.Set("If-None-Match", meta.ETag)
+			}
+			if meta.LastModified != "" {
+				req.Header.Set("If-Modified-Since", meta.LastModified)
+			}
+		}
+	}
+
+	resp, err := f.client().Do(req)
 	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		return false, nil
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, f.store(resp, localFile)
+	case resp.StatusCode >= 500:
+		io.Copy(io.Discard, resp.Body)
+		return true, fmt.Errorf("server returned %s", resp.Status)
+	default:
+		io.Copy(io.Discard, resp.Body)
+		return false, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+}
+
+// store writes resp.Body to a temp file in localFile's directory, verifies
+// it against VerifySHA256 if set, and only then renames it into place and
+// updates the ETag/Last-Modified sidecar.
+func (f *Fetcher) store(resp *http.Response, localFile string) error {
+	dir := filepath.Dir(localFile)
+	tmp, err := os.CreateTemp(dir, ".fetch-*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	hasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hasher), resp.Body); err != nil {
+		tmp.Close()
 		return err
 	}
-	if err := os.WriteFile(localFile, resBody, 0644); err != nil {
+	if err := tmp.Close(); err != nil {
 		return err
 	}
+
+	if f.VerifySHA256 != "" {
+		sum := hex.EncodeToString(hasher.Sum(nil))
+		if !strings.EqualFold(sum, f.VerifySHA256) {
+			return fmt.Errorf("sha256 mismatch: expected %s, got %s", f.VerifySHA256, sum)
+		}
+	}
+
+	if err := os.Rename(tmpPath, localFile); err != nil {
+		return err
+	}
+
+	// localFile is correctly in place at this point; a failure persisting
+	// the sidecar only costs us a future conditional GET, not correctness,
+	// so it shouldn't fail the fetch.
+	if err := f.saveMeta(localFile, fetchMeta{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}); err != nil {
+		log.Printf("failed to persist fetch metadata for %s: %s\n", localFile, err)
+	}
 	return nil
 }
+
+var defaultFetcher = NewFetcher()
+
+// GetCacheHttpFile downloads url to localFile via the shared default
+// Fetcher. Kept as a package-level function since it's the call shape used
+// throughout config.go for loading keys over HTTP.
+func GetCacheHttpFile(url string, localFile string) error {
+	return defaultFetcher.Fetch(url, localFile)
+}
+
+// GetCacheHttpFileVerified behaves like GetCacheHttpFile but additionally
+// rejects the download unless its SHA-256 matches sha256Hex (a no-op check
+// when sha256Hex is empty). Used for key material fetched over HTTP, where
+// a pinned hash stops a compromised or MITM'd URL from silently swapping
+// in a different key.
+func GetCacheHttpFileVerified(url string, localFile string, sha256Hex string) error {
+	fetcher := *defaultFetcher
+	fetcher.VerifySHA256 = sha256Hex
+	return fetcher.Fetch(url, localFile)
+}
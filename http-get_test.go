@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testFetcher() *Fetcher {
+	return &Fetcher{
+		Client:     &http.Client{Timeout: 2 * time.Second},
+		MaxRetries: 3,
+		RetryDelay: time.Millisecond,
+	}
+}
+
+func TestFetchDownloadsAndCachesETag(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"abc123"`)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("hello"))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	localFile := filepath.Join(dir, "cached")
+
+	if err := testFetcher().Fetch(srv.URL, localFile); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	data, err := os.ReadFile(localFile)
+	if err != nil {
+		t.Fatalf("expected file to exist: %s", err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("expected 'hello', got %q", data)
+	}
+	if _, err := os.Stat(metaPath(localFile)); err != nil {
+		t.Fatalf("expected sidecar metadata to exist: %s", err)
+	}
+}
+
+func TestFetchHonorsNotModified(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.Header.Get("If-None-Match") == `"abc123"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"abc123"`)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("hello"))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	localFile := filepath.Join(dir, "cached")
+	fetcher := testFetcher()
+
+	if err := fetcher.Fetch(srv.URL, localFile); err != nil {
+		t.Fatalf("unexpected error on first fetch: %s", err)
+	}
+	if err := fetcher.Fetch(srv.URL, localFile); err != nil {
+		t.Fatalf("unexpected error on conditional fetch: %s", err)
+	}
+	if requests != 2 {
+		t.Fatalf("expected 2 requests, got %d", requests)
+	}
+	data, _ := os.ReadFile(localFile)
+	if string(data) != "hello" {
+		t.Fatalf("expected cached file to still read 'hello', got %q", data)
+	}
+}
+
+func TestFetchRetriesOn5xx(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&requests, 1)
+		if n < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("hello"))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	localFile := filepath.Join(dir, "cached")
+
+	if err := testFetcher().Fetch(srv.URL, localFile); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if requests != 3 {
+		t.Fatalf("expected 3 requests, got %d", requests)
+	}
+}
+
+func TestFetchDoesNotRetryOn4xx(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	localFile := filepath.Join(dir, "cached")
+
+	if err := testFetcher().Fetch(srv.URL, localFile); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	if requests != 1 {
+		t.Fatalf("expected exactly 1 request for a non-retryable status, got %d", requests)
+	}
+}
+
+func TestFetchNetworkErrorIsRetried(t *testing.T) {
+	dir := t.TempDir()
+	localFile := filepath.Join(dir, "cached")
+
+	fetcher := &Fetcher{Client: &http.Client{Timeout: 100 * time.Millisecond}, MaxRetries: 2, RetryDelay: time.Millisecond}
+	if err := fetcher.Fetch("http://127.0.0.1:1", localFile); err == nil {
+		t.Fatal("expected error connecting to an unreachable address")
+	}
+	if _, err := os.Stat(localFile); err == nil {
+		t.Fatal("expected no file to be written on failure")
+	}
+}
+
+func TestFetchRejectsHashMismatch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("hello"))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	localFile := filepath.Join(dir, "cached")
+
+	fetcher := testFetcher()
+	fetcher.VerifySHA256 = "0000000000000000000000000000000000000000000000000000000000000000"
+	if err := fetcher.Fetch(srv.URL, localFile); err == nil {
+		t.Fatal("expected a hash mismatch error")
+	}
+	if _, err := os.Stat(localFile); err == nil {
+		t.Fatal("expected no file to be written on hash mismatch")
+	}
+}
+
+func TestFetchWithPinnedHashNeverTrustsA304(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != "" {
+			t.Errorf("unexpected conditional request headers with a pinned hash: %v", r.Header)
+		}
+		w.Header().Set("ETag", `"abc123"`)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("hello"))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	localFile := filepath.Join(dir, "cached")
+	fetcher := testFetcher()
+	sum := sha256.Sum256([]byte("hello"))
+	fetcher.VerifySHA256 = hex.EncodeToString(sum[:])
+
+	if err := fetcher.Fetch(srv.URL, localFile); err != nil {
+		t.Fatalf("unexpected error on first fetch: %s", err)
+	}
+	if err := fetcher.Fetch(srv.URL, localFile); err != nil {
+		t.Fatalf("unexpected error on second fetch: %s", err)
+	}
+	if requests != 2 {
+		t.Fatalf("expected every fetch to be a full, verified GET, got %d requests", requests)
+	}
+}
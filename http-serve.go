@@ -13,6 +13,7 @@ import (
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func sendJSON(w http.ResponseWriter, v interface{}) {
@@ -58,8 +59,15 @@ func validateAuth(next http.HandlerFunc) http.HandlerFunc {
 
 func serveHTTP() {
 	router := mux.NewRouter()
+	router.Use(withRequestID)
 	router.HandleFunc("/api/1/vehicles/{vin}/command/{command}", validateAuth(handleExecCommand)).Methods("POST")
 	router.HandleFunc("/api/1/vehicles/{vin}/data/{command}", validateAuth(handleGetDataCommand)).Methods("GET")
+	router.HandleFunc("/api/1/vehicles/{vin}/session/reset", validateAuth(handleResetSession)).Methods("POST")
+	router.HandleFunc("/api/1/jobs/{id}", validateAuth(handleGetJob)).Methods("GET")
+	router.HandleFunc("/metrics", validateAuth(promhttp.Handler().ServeHTTP)).Methods("GET")
+	if GetConfig().RelayMode == "controller" {
+		registerRelayRoutes(router)
+	}
 
 	httpServer := &http.Server{
 		Addr:         fmt.Sprintf("0.0.0.0:%d", GetConfig().Port),
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+var logger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+type contextKey string
+
+const requestIDContextKey contextKey = "request_id"
+
+// withRequestID middleware assigns a ULID to every incoming request,
+// stores it on the context, and echoes it back so client-side logs can
+// be correlated with server-side ones.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := newRequestID()
+		w.Header().Set("X-Request-Id", id)
+		ctx := context.WithValue(r.Context(), requestIDContextKey, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func newRequestID() string {
+	entropy := ulid.Monotonic(rand.Reader, 0)
+	return ulid.MustNew(ulid.Timestamp(time.Now()), entropy).String()
+}
+
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey).(string)
+	return id
+}
+
+// logCommand emits one structured log line per command attempt, with
+// enough fields to reconstruct what happened for a given vin/request
+// without grepping free-form text.
+func logCommand(ctx context.Context, vin string, command string, try int, duration time.Duration, err error) {
+	attrs := []any{
+		"request_id", requestIDFrom(ctx),
+		"vin", vin,
+		"command", command,
+		"try", try,
+		"duration_ms", duration.Milliseconds(),
+	}
+	if err != nil {
+		logger.Error("command failed", append(attrs, "err", err.Error())...)
+		return
+	}
+	logger.Info("command succeeded", attrs...)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var metricCommandsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "tesla_ble",
+	Name:      "commands_total",
+	Help:      "Total number of vehicle commands executed, by VIN, command and result.",
+}, []string{"vin", "command", "result"})
+
+var metricCommandDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "tesla_ble",
+	Name:      "command_duration_seconds",
+	Help:      "Time spent executing a vehicle command, by command.",
+}, []string{"command"})
+
+var metricHandshakeDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+	Namespace: "tesla_ble",
+	Name:      "handshake_duration_seconds",
+	Help:      "Time spent performing the BLE connect + session handshake.",
+})
+
+var metricCachedSessions = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: "tesla_ble",
+	Name:      "cached_sessions",
+	Help:      "Number of vehicles with a cached BLE session.",
+})
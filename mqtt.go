@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// startMQTT connects to the configured broker and wires up command
+// subscriptions and periodic state publishing for every VIN in
+// GetConfig().MQTTVINs. It is a no-op when MQTT_BROKER is not set.
+func startMQTT() {
+	config := GetConfig()
+	if config.MQTTBroker == "" {
+		return
+	}
+
+	availableTopic := fmt.Sprintf("%s/available", config.MQTTTopicPrefix)
+
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(config.MQTTBroker)
+	opts.SetUsername(config.MQTTUsername)
+	opts.SetPassword(config.MQTTPassword)
+	opts.SetClientID("tesla-ble")
+	if tlsConfig, err := buildMQTTTLSConfig(config); err != nil {
+		log.Printf("Failed to set up MQTT TLS: %s\n", err)
+		return
+	} else if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+	opts.SetWill(availableTopic, "offline", 1, true)
+	opts.SetAutoReconnect(true)
+	opts.SetOnConnectHandler(func(client mqtt.Client) {
+		log.Println("Connected to MQTT broker")
+		client.Publish(availableTopic, 1, true, "online")
+		for _, vin := range config.MQTTVINs {
+			subscribeMQTTCommands(client, vin)
+		}
+	})
+
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		log.Printf("Failed to connect to MQTT broker: %s\n", token.Error())
+		return
+	}
+
+	go publishMQTTStateLoop(client)
+}
+
+// buildMQTTTLSConfig assembles a *tls.Config from the configured CA/client
+// certificate files. It returns nil, nil when the broker URL doesn't use a
+// TLS scheme and no certificates were configured, so startMQTT can skip
+// calling SetTLSConfig entirely for the common plaintext case.
+func buildMQTTTLSConfig(config *Config) (*tls.Config, error) {
+	wantsTLS := strings.HasPrefix(config.MQTTBroker, "ssl://") ||
+		strings.HasPrefix(config.MQTTBroker, "tls://") ||
+		strings.HasPrefix(config.MQTTBroker, "mqtts://")
+	if !wantsTLS && config.MQTTCACert == "" && config.MQTTClientCert == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.MQTTTLSInsecureSkipVerify}
+
+	if config.MQTTCACert != "" {
+		pem, err := os.ReadFile(config.MQTTCACert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read MQTT CA cert: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("failed to parse MQTT CA cert %s", config.MQTTCACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.MQTTClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(config.MQTTClientCert, config.MQTTClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load MQTT client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// subscribeMQTTCommands subscribes to <prefix>/<vin>/command/<name> and
+// dispatches incoming messages through the same queued command path the
+// HTTP API uses.
+func subscribeMQTTCommands(client mqtt.Client, vin string) {
+	topic := fmt.Sprintf("%s/%s/command/+", GetConfig().MQTTTopicPrefix, vin)
+	client.Subscribe(topic, 1, func(c mqtt.Client, msg mqtt.Message) {
+		parts := strings.Split(msg.Topic(), "/")
+		command := parts[len(parts)-1]
+
+		var body map[string]interface{}
+		if len(msg.Payload()) > 0 {
+			if err := json.Unmarshal(msg.Payload(), &body); err != nil {
+				log.Printf("mqtt: failed to decode command %s body: %s\n", command, err)
+				return
+			}
+		}
+
+		if _, err := runQueued(vin, func() (interface{}, error) {
+			if needWakeUp(command) {
+				if err := execCommand(context.Background(), vin, "wake_up", body); err != nil {
+					return nil, fmt.Errorf("waking vehicle failed: %s", err)
+				}
+				time.Sleep(5 * time.Second)
+			}
+			return nil, execCommand(context.Background(), vin, command, body)
+		}); err != nil {
+			log.Printf("mqtt: command %s for VIN %s failed: %s\n", command, vin, err)
+		}
+	})
+}
+
+// publishMQTTStateLoop periodically publishes a handful of commonly
+// wanted charge state values as retained messages, so subscribers like
+// Home Assistant or evcc always have a last-known value without needing
+// to poll HTTP.
+func publishMQTTStateLoop(client mqtt.Client) {
+	config := GetConfig()
+	ticker := time.NewTicker(config.MQTTPollInterval)
+	defer ticker.Stop()
+
+	for ; true; <-ticker.C {
+		for _, vin := range config.MQTTVINs {
+			publishMQTTState(client, vin)
+		}
+	}
+}
+
+func publishMQTTState(client mqtt.Client, vin string) {
+	prefix := fmt.Sprintf("%s/%s/state", GetConfig().MQTTTopicPrefix, vin)
+	publishers := map[string]string{
+		"soc":           "get_soc",
+		"soc_limit":     "get_soc_limit",
+		"battery_range": "get_battery_range",
+		"charge_state":  "get_charge_state",
+	}
+
+	for topicSuffix, command := range publishers {
+		data, err := runQueued(vin, func() (interface{}, error) {
+			return execDataCommand(context.Background(), vin, command, false)
+		})
+		if err != nil {
+			log.Printf("mqtt: failed to fetch %s for VIN %s: %s\n", command, vin, err)
+			continue
+		}
+		payload, err := json.Marshal(data)
+		if err != nil {
+			continue
+		}
+		client.Publish(fmt.Sprintf("%s/%s", prefix, topicSuffix), 1, true, payload)
+	}
+}
@@ -0,0 +1,181 @@
+// Package action provides typed, transport-agnostic wrappers around the
+// vehicle commands this module supports. An Action knows how to execute
+// itself against a VehicleCommander; transports (HTTP today, others later)
+// are only responsible for building one from their input and handing it to
+// a dispatcher.
+package action
+
+import (
+	"context"
+	"crypto/ecdh"
+	"fmt"
+	"strings"
+
+	"github.com/teslamotors/vehicle-command/pkg/protocol/protobuf/vcsec"
+)
+
+// VehicleCommander is the subset of *vehicle.Vehicle's command surface that
+// actions need. It exists so Action implementations can be unit tested
+// against a mock instead of a live BLE session.
+type VehicleCommander interface {
+	SendAddKeyRequest(ctx context.Context, publicKey *ecdh.PublicKey, isOwner bool, formFactor vcsec.KeyFormFactor) error
+	Wakeup(ctx context.Context) error
+	SetChargingAmps(ctx context.Context, amps int32) error
+	ChangeChargeLimit(ctx context.Context, chargeLimitPercent int32) error
+	ChargeStart(ctx context.Context) error
+	ChargeStop(ctx context.Context) error
+}
+
+// Category groups actions for things like dispatcher routing or future
+// per-category rate limiting.
+type Category string
+
+const (
+	CategoryAccess Category = "access"
+	CategoryCharge Category = "charge"
+)
+
+// Action is a single vehicle command that can be executed against a
+// connected vehicle session.
+type Action interface {
+	// Name is the command name as used in the HTTP API, e.g. "charge_start".
+	Name() string
+	// Category groups related actions, e.g. for rate limiting.
+	Category() Category
+	// Execute runs the action against car. Implementations should wrap
+	// underlying errors with context, mirroring the rest of the module.
+	Execute(ctx context.Context, car VehicleCommander) error
+}
+
+type pairAction struct {
+	PublicKey *ecdh.PublicKey
+}
+
+func (a *pairAction) Name() string       { return "pair" }
+func (a *pairAction) Category() Category { return CategoryAccess }
+
+func (a *pairAction) Execute(ctx context.Context, car VehicleCommander) error {
+	if err := car.SendAddKeyRequest(ctx, a.PublicKey, true, vcsec.KeyFormFactor_KEY_FORM_FACTOR_UNKNOWN); err != nil {
+		return fmt.Errorf("failed to send add key request: %s", err)
+	}
+	return nil
+}
+
+// Pair requests that publicKey be added as a new key to the vehicle.
+func Pair(publicKey *ecdh.PublicKey) Action {
+	return &pairAction{PublicKey: publicKey}
+}
+
+type wakeUpAction struct{}
+
+func (a *wakeUpAction) Name() string       { return "wake_up" }
+func (a *wakeUpAction) Category() Category { return CategoryAccess }
+
+func (a *wakeUpAction) Execute(ctx context.Context, car VehicleCommander) error {
+	if err := car.Wakeup(ctx); err != nil {
+		return fmt.Errorf("failed to wake up vehicle: %s", err)
+	}
+	return nil
+}
+
+// WakeUp wakes the vehicle up.
+func WakeUp() Action {
+	return &wakeUpAction{}
+}
+
+type setChargingAmpsAction struct {
+	Amps int32
+}
+
+func (a *setChargingAmpsAction) Name() string       { return "set_charging_amps" }
+func (a *setChargingAmpsAction) Category() Category { return CategoryCharge }
+
+func (a *setChargingAmpsAction) Execute(ctx context.Context, car VehicleCommander) error {
+	if err := car.SetChargingAmps(ctx, a.Amps); err != nil {
+		return fmt.Errorf("failed to set charging amps: %s", err)
+	}
+	return nil
+}
+
+// SetChargingAmps sets the maximum charge current in amps.
+func SetChargingAmps(amps int32) Action {
+	return &setChargingAmpsAction{Amps: amps}
+}
+
+type changeChargeLimitAction struct {
+	Percent int32
+}
+
+func (a *changeChargeLimitAction) Name() string       { return "set_soc_limit" }
+func (a *changeChargeLimitAction) Category() Category { return CategoryCharge }
+
+func (a *changeChargeLimitAction) Execute(ctx context.Context, car VehicleCommander) error {
+	if err := car.ChangeChargeLimit(ctx, a.Percent); err != nil {
+		return fmt.Errorf("failed to set soc limit: %s", err)
+	}
+	return nil
+}
+
+// ChangeChargeLimit sets the charge limit to percent (0-100).
+func ChangeChargeLimit(percent int32) Action {
+	return &changeChargeLimitAction{Percent: percent}
+}
+
+type chargeStartAction struct{}
+
+func (a *chargeStartAction) Name() string       { return "charge_start" }
+func (a *chargeStartAction) Category() Category { return CategoryCharge }
+
+func (a *chargeStartAction) Execute(ctx context.Context, car VehicleCommander) error {
+	if err := car.ChargeStart(ctx); err != nil {
+		if strings.Contains(err.Error(), "already_started") || strings.Contains(err.Error(), "is_charging") {
+			return nil
+		}
+		return fmt.Errorf("failed to start charging: %s", err)
+	}
+	return nil
+}
+
+// ChargeStart starts charging, treating "already charging" as success.
+func ChargeStart() Action {
+	return &chargeStartAction{}
+}
+
+type chargeStopAction struct{}
+
+func (a *chargeStopAction) Name() string       { return "charge_stop" }
+func (a *chargeStopAction) Category() Category { return CategoryCharge }
+
+func (a *chargeStopAction) Execute(ctx context.Context, car VehicleCommander) error {
+	if err := car.ChargeStop(ctx); err != nil {
+		if strings.Contains(err.Error(), "not_charging") {
+			return nil
+		}
+		return fmt.Errorf("failed to stop charging: %s", err)
+	}
+	return nil
+}
+
+// ChargeStop stops charging, treating "not charging" as success.
+func ChargeStop() Action {
+	return &chargeStopAction{}
+}
+
+type chargeEnableAction struct {
+	Enable bool
+}
+
+func (a *chargeEnableAction) Name() string       { return "charge" }
+func (a *chargeEnableAction) Category() Category { return CategoryCharge }
+
+func (a *chargeEnableAction) Execute(ctx context.Context, car VehicleCommander) error {
+	if a.Enable {
+		return ChargeStart().Execute(ctx, car)
+	}
+	return ChargeStop().Execute(ctx, car)
+}
+
+// ChargeEnable starts or stops charging depending on enable.
+func ChargeEnable(enable bool) Action {
+	return &chargeEnableAction{Enable: enable}
+}
@@ -0,0 +1,128 @@
+package action
+
+import (
+	"context"
+	"crypto/ecdh"
+	"errors"
+	"testing"
+
+	"github.com/teslamotors/vehicle-command/pkg/protocol/protobuf/vcsec"
+)
+
+// mockCommander records calls and returns canned errors, so Action.Execute
+// can be exercised without a real BLE session.
+type mockCommander struct {
+	sendAddKeyErr        error
+	wakeupErr            error
+	setChargingAmpsErr   error
+	changeChargeLimitErr error
+	chargeStartErr       error
+	chargeStopErr        error
+
+	lastChargingAmps int32
+	lastChargeLimit  int32
+}
+
+func (m *mockCommander) SendAddKeyRequest(ctx context.Context, publicKey *ecdh.PublicKey, isOwner bool, formFactor vcsec.KeyFormFactor) error {
+	return m.sendAddKeyErr
+}
+
+func (m *mockCommander) Wakeup(ctx context.Context) error {
+	return m.wakeupErr
+}
+
+func (m *mockCommander) SetChargingAmps(ctx context.Context, amps int32) error {
+	m.lastChargingAmps = amps
+	return m.setChargingAmpsErr
+}
+
+func (m *mockCommander) ChangeChargeLimit(ctx context.Context, chargeLimitPercent int32) error {
+	m.lastChargeLimit = chargeLimitPercent
+	return m.changeChargeLimitErr
+}
+
+func (m *mockCommander) ChargeStart(ctx context.Context) error {
+	return m.chargeStartErr
+}
+
+func (m *mockCommander) ChargeStop(ctx context.Context) error {
+	return m.chargeStopErr
+}
+
+func TestWakeUpWrapsError(t *testing.T) {
+	car := &mockCommander{wakeupErr: errors.New("boom")}
+	if err := WakeUp().Execute(context.Background(), car); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+}
+
+func TestSetChargingAmpsPassesValue(t *testing.T) {
+	car := &mockCommander{}
+	if err := SetChargingAmps(16).Execute(context.Background(), car); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if car.lastChargingAmps != 16 {
+		t.Fatalf("expected 16 amps, got %d", car.lastChargingAmps)
+	}
+}
+
+func TestChangeChargeLimitPassesValue(t *testing.T) {
+	car := &mockCommander{}
+	if err := ChangeChargeLimit(80).Execute(context.Background(), car); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if car.lastChargeLimit != 80 {
+		t.Fatalf("expected 80%%, got %d", car.lastChargeLimit)
+	}
+}
+
+func TestChargeStartTreatsAlreadyChargingAsSuccess(t *testing.T) {
+	car := &mockCommander{chargeStartErr: errors.New("already_started")}
+	if err := ChargeStart().Execute(context.Background(), car); err != nil {
+		t.Fatalf("expected already_started to be treated as success, got %s", err)
+	}
+}
+
+func TestChargeStopTreatsNotChargingAsSuccess(t *testing.T) {
+	car := &mockCommander{chargeStopErr: errors.New("not_charging")}
+	if err := ChargeStop().Execute(context.Background(), car); err != nil {
+		t.Fatalf("expected not_charging to be treated as success, got %s", err)
+	}
+}
+
+func TestChargeStartPropagatesOtherErrors(t *testing.T) {
+	car := &mockCommander{chargeStartErr: errors.New("connection_lost")}
+	if err := ChargeStart().Execute(context.Background(), car); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+}
+
+func TestChargeEnableDispatchesStartAndStop(t *testing.T) {
+	car := &mockCommander{}
+	if err := ChargeEnable(true).Execute(context.Background(), car); err != nil {
+		t.Fatalf("unexpected error starting charge: %s", err)
+	}
+	if err := ChargeEnable(false).Execute(context.Background(), car); err != nil {
+		t.Fatalf("unexpected error stopping charge: %s", err)
+	}
+}
+
+func TestCategories(t *testing.T) {
+	cases := []struct {
+		action   Action
+		expected Category
+	}{
+		{Pair(nil), CategoryAccess},
+		{WakeUp(), CategoryAccess},
+		{SetChargingAmps(10), CategoryCharge},
+		{ChangeChargeLimit(80), CategoryCharge},
+		{ChargeStart(), CategoryCharge},
+		{ChargeStop(), CategoryCharge},
+		{ChargeEnable(true), CategoryCharge},
+	}
+	for _, c := range cases {
+		if got := c.action.Category(); got != c.expected {
+			t.Errorf("%s: expected category %s, got %s", c.action.Name(), c.expected, got)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// vinQueue serializes all BLE work for a single VIN. BLE only supports
+// one connection at a time per vehicle, so two concurrent HTTP requests
+// for the same VIN must never race inside prepareConnection.
+type vinQueue struct {
+	work chan func()
+}
+
+var vinQueues sync.Map // map[string]*vinQueue
+
+func getVinQueue(vin string) *vinQueue {
+	if existing, ok := vinQueues.Load(vin); ok {
+		return existing.(*vinQueue)
+	}
+	q := &vinQueue{work: make(chan func(), 32)}
+	actual, loaded := vinQueues.LoadOrStore(vin, q)
+	if !loaded {
+		go func() {
+			for fn := range q.work {
+				fn()
+			}
+		}()
+	}
+	return actual.(*vinQueue)
+}
+
+// jobStatus is the lifecycle of an asynchronously submitted job.
+type jobStatus string
+
+const (
+	jobStatusPending jobStatus = "pending"
+	jobStatusRunning jobStatus = "running"
+	jobStatusDone    jobStatus = "done"
+	jobStatusError   jobStatus = "error"
+)
+
+// asyncJob tracks one unit of queued work, whether it was requested
+// synchronously (the caller just waits on done) or asynchronously
+// (the caller polls GET /api/1/jobs/{id}).
+type asyncJob struct {
+	mu        sync.Mutex
+	Status    jobStatus   `json:"status"`
+	Result    interface{} `json:"result,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	err       error
+	done      chan struct{}
+	createdAt time.Time
+}
+
+func (j *asyncJob) snapshot() asyncJob {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return asyncJob{Status: j.Status, Result: j.Result, Error: j.Error}
+}
+
+// isTerminal reports whether the job has finished (successfully or not).
+func (j *asyncJob) isTerminal() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.Status == jobStatusDone || j.Status == jobStatusError
+}
+
+var jobStore sync.Map // map[string]*asyncJob
+
+// jobTTL bounds how long a finished async job's result stays in jobStore
+// after a client stops polling for it, so fire-and-forget async requests
+// don't leak one *asyncJob per call for the life of the process.
+const jobTTL = 30 * time.Minute
+const jobSweepInterval = 5 * time.Minute
+
+func init() {
+	go sweepJobStore()
+}
+
+// sweepJobStore periodically evicts terminal jobs older than jobTTL,
+// catching jobs whose submitter never polled GET /api/1/jobs/{id} at all.
+// The common poll-until-done path is additionally evicted as soon as it's
+// observed terminal, in handleGetJob below.
+func sweepJobStore() {
+	ticker := time.NewTicker(jobSweepInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		jobStore.Range(func(key, value interface{}) bool {
+			job := value.(*asyncJob)
+			job.mu.Lock()
+			expired := (job.Status == jobStatusDone || job.Status == jobStatusError) && now.Sub(job.createdAt) > jobTTL
+			job.mu.Unlock()
+			if expired {
+				jobStore.Delete(key)
+			}
+			return true
+		})
+	}
+}
+
+func newJobID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// submitJob queues work to run serialized behind everything else already
+// queued for vin, and returns immediately with a job the caller can wait
+// on (for the synchronous API) or register under a job id (for async).
+func submitJob(vin string, work func() (interface{}, error)) *asyncJob {
+	job := &asyncJob{Status: jobStatusPending, done: make(chan struct{}), createdAt: time.Now()}
+	q := getVinQueue(vin)
+	q.work <- func() {
+		job.mu.Lock()
+		job.Status = jobStatusRunning
+		job.mu.Unlock()
+
+		result, err := work()
+
+		job.mu.Lock()
+		if err != nil {
+			job.Status = jobStatusError
+			job.Error = err.Error()
+			job.err = err
+		} else {
+			job.Status = jobStatusDone
+			job.Result = result
+		}
+		job.mu.Unlock()
+		close(job.done)
+	}
+	return job
+}
+
+// runQueued submits work and blocks until it has run, for callers that
+// want the traditional synchronous HTTP behavior.
+func runQueued(vin string, work func() (interface{}, error)) (interface{}, error) {
+	job := submitJob(vin, work)
+	<-job.done
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	if job.Status == jobStatusError {
+		return nil, job.err
+	}
+	return job.Result, nil
+}
+
+// handleGetJob reports the status of a job previously submitted via
+// ?async=true. Once the job is observed in a terminal state it's evicted
+// from jobStore immediately, since the documented poll-until-done client
+// pattern has no further use for it.
+func handleGetJob(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	v, ok := jobStore.Load(id)
+	if !ok {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	job := v.(*asyncJob)
+	if job.isTerminal() {
+		jobStore.Delete(id)
+	}
+	sendJSON(w, job.snapshot())
+}
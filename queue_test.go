@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestSubmitJobRunsFIFOPerVIN(t *testing.T) {
+	vin := "TESTVIN-FIFO"
+	var mu sync.Mutex
+	var order []int
+
+	jobs := make([]*asyncJob, 5)
+	for i := 0; i < 5; i++ {
+		i := i
+		jobs[i] = submitJob(vin, func() (interface{}, error) {
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+			return i, nil
+		})
+	}
+	for _, j := range jobs {
+		<-j.done
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	expected := []int{0, 1, 2, 3, 4}
+	if len(order) != len(expected) {
+		t.Fatalf("expected %d jobs to run, got %d", len(expected), len(order))
+	}
+	for i, v := range order {
+		if v != expected[i] {
+			t.Fatalf("expected FIFO order %v, got %v", expected, order)
+		}
+	}
+}
+
+func TestSubmitJobStatusTransitions(t *testing.T) {
+	vin := "TESTVIN-STATUS"
+	start := make(chan struct{})
+	release := make(chan struct{})
+
+	job := submitJob(vin, func() (interface{}, error) {
+		close(start)
+		<-release
+		return "ok", nil
+	})
+
+	<-start
+	job.mu.Lock()
+	status := job.Status
+	job.mu.Unlock()
+	if status != jobStatusRunning {
+		t.Fatalf("expected status %q while work is in flight, got %q", jobStatusRunning, status)
+	}
+
+	close(release)
+	<-job.done
+
+	snap := job.snapshot()
+	if snap.Status != jobStatusDone {
+		t.Fatalf("expected status %q after completion, got %q", jobStatusDone, snap.Status)
+	}
+	if snap.Result != "ok" {
+		t.Fatalf("expected result %q, got %v", "ok", snap.Result)
+	}
+}
+
+func TestRunQueuedPropagatesError(t *testing.T) {
+	vin := "TESTVIN-ERROR"
+	_, err := runQueued(vin, func() (interface{}, error) {
+		return nil, errors.New("boom")
+	})
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+}
+
+func TestHandleGetJobNotFound(t *testing.T) {
+	router := mux.NewRouter()
+	router.HandleFunc("/api/1/jobs/{id}", handleGetJob).Methods("GET")
+
+	req := httptest.NewRequest(http.MethodGet, "/api/1/jobs/does-not-exist", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", rec.Code)
+	}
+}
+
+func TestHandleGetJobReturnsStatus(t *testing.T) {
+	vin := "TESTVIN-HANDLER"
+	job := submitJob(vin, func() (interface{}, error) {
+		return "value", nil
+	})
+	<-job.done
+
+	id := newJobID()
+	jobStore.Store(id, job)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/1/jobs/{id}", handleGetJob).Methods("GET")
+
+	req := httptest.NewRequest(http.MethodGet, "/api/1/jobs/"+id, nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("failed to decode response: %s", err)
+	}
+	if body["status"] != string(jobStatusDone) {
+		t.Fatalf("expected status %q, got %v", jobStatusDone, body["status"])
+	}
+	if body["result"] != "value" {
+		t.Fatalf("expected result %q, got %v", "value", body["result"])
+	}
+
+	if _, ok := jobStore.Load(id); ok {
+		t.Fatal("expected job to be evicted from jobStore after being observed terminal")
+	}
+}
+
+func TestHandleGetJobKeepsPendingJob(t *testing.T) {
+	vin := "TESTVIN-PENDING"
+	release := make(chan struct{})
+	job := submitJob(vin, func() (interface{}, error) {
+		<-release
+		return nil, nil
+	})
+	defer close(release)
+
+	id := newJobID()
+	jobStore.Store(id, job)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/1/jobs/{id}", handleGetJob).Methods("GET")
+
+	req := httptest.NewRequest(http.MethodGet, "/api/1/jobs/"+id, nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if _, ok := jobStore.Load(id); !ok {
+		t.Fatal("expected a non-terminal job to remain in jobStore")
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// relayEnvelope is the JSON frame exchanged between an agent and the
+// controller over the relay WebSocket connection.
+type relayEnvelope struct {
+	Type    string          `json:"type"` // register, exec, data, result
+	ID      string          `json:"id,omitempty"`
+	VIN     string          `json:"vin,omitempty"`
+	Command string          `json:"command,omitempty"`
+	Body    json.RawMessage `json:"body,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   string          `json:"error,omitempty"`
+	Nonce   string          `json:"nonce,omitempty"`
+	Digest  string          `json:"digest,omitempty"`
+}
+
+var errRelayAgentNotConnected = errors.New("no relay agent connected for this VIN")
+var errRelayTimeout = errors.New("relay agent did not respond in time")
+
+// relayAgentConn represents one agent's persistent connection on the
+// controller side.
+type relayAgentConn struct {
+	conn    *websocket.Conn
+	writeMu sync.Mutex
+
+	pendingMu sync.Mutex
+	pending   map[string]chan relayEnvelope
+}
+
+func (a *relayAgentConn) send(msg relayEnvelope) error {
+	a.writeMu.Lock()
+	defer a.writeMu.Unlock()
+	return a.conn.WriteJSON(msg)
+}
+
+func (a *relayAgentConn) await(id string, timeout time.Duration) (relayEnvelope, error) {
+	ch := make(chan relayEnvelope, 1)
+	a.pendingMu.Lock()
+	a.pending[id] = ch
+	a.pendingMu.Unlock()
+	defer func() {
+		a.pendingMu.Lock()
+		delete(a.pending, id)
+		a.pendingMu.Unlock()
+	}()
+
+	select {
+	case res := <-ch:
+		return res, nil
+	case <-time.After(timeout):
+		return relayEnvelope{}, errRelayTimeout
+	}
+}
+
+// relayController keeps track of the agents currently registered with
+// this process when running in RELAY_MODE=controller.
+type relayController struct {
+	mu     sync.RWMutex
+	agents map[string]*relayAgentConn
+}
+
+var relayHub = &relayController{agents: make(map[string]*relayAgentConn)}
+
+func (c *relayController) register(vin string, agent *relayAgentConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.agents[vin] = agent
+}
+
+func (c *relayController) unregister(vin string, agent *relayAgentConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.agents[vin] == agent {
+		delete(c.agents, vin)
+	}
+}
+
+func (c *relayController) get(vin string) (*relayAgentConn, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	agent, ok := c.agents[vin]
+	return agent, ok
+}
+
+func (c *relayController) dispatch(vin string, envelope relayEnvelope, timeout time.Duration) (relayEnvelope, error) {
+	agent, ok := c.get(vin)
+	if !ok {
+		return relayEnvelope{}, errRelayAgentNotConnected
+	}
+	envelope.ID = relayNewID()
+	if err := agent.send(envelope); err != nil {
+		c.unregister(vin, agent)
+		return relayEnvelope{}, fmt.Errorf("failed to send to relay agent: %s", err)
+	}
+	return agent.await(envelope.ID, timeout)
+}
+
+func relayNewID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+func relayDigest(vin string, nonce string) string {
+	mac := hmac.New(sha256.New, []byte(GetConfig().RelaySecret))
+	mac.Write([]byte(vin))
+	mac.Write([]byte(nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// relayExecCommand forwards an exec command to the agent owning vin and
+// waits for its result. Used by execCommand when running as a controller.
+func relayExecCommand(vin string, command string, body map[string]interface{}) error {
+	bodyJSON, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to marshal command body: %s", err)
+	}
+	res, err := relayHub.dispatch(vin, relayEnvelope{
+		Type:    "exec",
+		VIN:     vin,
+		Command: command,
+		Body:    bodyJSON,
+	}, 30*time.Second)
+	if err != nil {
+		return err
+	}
+	if res.Error != "" {
+		if res.Error == errCmdNotFound.Error() {
+			return errCmdNotFound
+		}
+		return errors.New(res.Error)
+	}
+	return nil
+}
+
+// relayExecDataCommand forwards a data command to the agent owning vin
+// and waits for its result. Used by execDataCommand when running as a
+// controller.
+func relayExecDataCommand(vin string, command string) (interface{}, error) {
+	res, err := relayHub.dispatch(vin, relayEnvelope{
+		Type:    "data",
+		VIN:     vin,
+		Command: command,
+	}, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if res.Error != "" {
+		if res.Error == errCmdNotFound.Error() {
+			return nil, errCmdNotFound
+		}
+		return nil, errors.New(res.Error)
+	}
+	var data interface{}
+	if err := json.Unmarshal(res.Result, &data); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal relay result: %s", err)
+	}
+	return data, nil
+}
+
+var relayUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// handleRelayConnect accepts the inbound WebSocket connection of a BLE
+// agent registering for a VIN. It issues a fresh, single-use challenge
+// nonce and only trusts a register message whose digest was computed
+// over that nonce, so a captured register frame can't be replayed
+// against a later connection. The connection is kept open for the
+// agent's lifetime and used to route commands to it.
+func handleRelayConnect(w http.ResponseWriter, r *http.Request) {
+	conn, err := relayUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("failed to upgrade relay connection: %s\n", err)
+		return
+	}
+
+	challenge := relayNewID()
+	if err := conn.WriteJSON(relayEnvelope{Type: "challenge", Nonce: challenge}); err != nil {
+		log.Printf("failed to send relay challenge: %s\n", err)
+		conn.Close()
+		return
+	}
+
+	var register relayEnvelope
+	if err := conn.ReadJSON(&register); err != nil || register.Type != "register" || register.VIN == "" {
+		log.Println("relay agent sent an invalid registration message")
+		conn.Close()
+		return
+	}
+	if !hmac.Equal([]byte(register.Digest), []byte(relayDigest(register.VIN, challenge))) {
+		log.Printf("relay agent for VIN %s failed HMAC handshake\n", register.VIN)
+		conn.Close()
+		return
+	}
+
+	agent := &relayAgentConn{conn: conn, pending: make(map[string]chan relayEnvelope)}
+	relayHub.register(register.VIN, agent)
+	log.Printf("relay agent for VIN %s connected\n", register.VIN)
+	defer func() {
+		relayHub.unregister(register.VIN, agent)
+		conn.Close()
+		log.Printf("relay agent for VIN %s disconnected\n", register.VIN)
+	}()
+
+	for {
+		var msg relayEnvelope
+		if err := conn.ReadJSON(&msg); err != nil {
+			return
+		}
+		if msg.Type != "result" {
+			continue
+		}
+		agent.pendingMu.Lock()
+		ch, ok := agent.pending[msg.ID]
+		agent.pendingMu.Unlock()
+		if ok {
+			ch <- msg
+		}
+	}
+}
+
+// runRelayAgent dials the controller configured via RELAY_URL, registers
+// this process' VIN, and executes any exec/data commands the controller
+// forwards to it through the existing local command maps. It reconnects
+// with a fixed backoff if the connection drops.
+func runRelayAgent() {
+	for {
+		if err := connectRelayAgent(); err != nil {
+			log.Printf("relay agent connection failed: %s\n", err)
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func connectRelayAgent() error {
+	config := GetConfig()
+	header := http.Header{}
+	if config.Username != "" || config.Password != "" {
+		req, _ := http.NewRequest("GET", config.RelayURL, nil)
+		req.SetBasicAuth(config.Username, config.Password)
+		header = req.Header
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(config.RelayURL, header)
+	if err != nil {
+		return fmt.Errorf("failed to dial relay controller: %s", err)
+	}
+	defer conn.Close()
+
+	var challenge relayEnvelope
+	if err := conn.ReadJSON(&challenge); err != nil || challenge.Type != "challenge" || challenge.Nonce == "" {
+		return fmt.Errorf("did not receive a valid challenge from relay controller")
+	}
+
+	register := relayEnvelope{
+		Type:   "register",
+		VIN:    config.RelayVIN,
+		Digest: relayDigest(config.RelayVIN, challenge.Nonce),
+	}
+	if err := conn.WriteJSON(register); err != nil {
+		return fmt.Errorf("failed to register with relay controller: %s", err)
+	}
+	log.Printf("registered with relay controller as VIN %s\n", config.RelayVIN)
+
+	for {
+		var msg relayEnvelope
+		if err := conn.ReadJSON(&msg); err != nil {
+			return fmt.Errorf("relay connection closed: %s", err)
+		}
+		go handleRelayRequest(conn, msg)
+	}
+}
+
+// handleRelayRequest runs a controller-dispatched exec/data command through
+// the same per-VIN queue the local HTTP API uses (see queue.go), so a
+// relayed command can't race a locally-issued one inside prepareConnection.
+func handleRelayRequest(conn *websocket.Conn, msg relayEnvelope) {
+	result := relayEnvelope{Type: "result", ID: msg.ID}
+
+	switch msg.Type {
+	case "exec":
+		var body map[string]interface{}
+		if len(msg.Body) > 0 {
+			if err := json.Unmarshal(msg.Body, &body); err != nil {
+				result.Error = fmt.Sprintf("failed to unmarshal command body: %s", err)
+				break
+			}
+		}
+		if _, err := runQueued(msg.VIN, func() (interface{}, error) {
+			return nil, execCommand(context.Background(), msg.VIN, msg.Command, body)
+		}); err != nil {
+			result.Error = err.Error()
+		}
+	case "data":
+		data, err := runQueued(msg.VIN, func() (interface{}, error) {
+			return execDataCommand(context.Background(), msg.VIN, msg.Command, false)
+		})
+		if err != nil {
+			result.Error = err.Error()
+			break
+		}
+		resultJSON, err := json.Marshal(data)
+		if err != nil {
+			result.Error = fmt.Sprintf("failed to marshal command result: %s", err)
+			break
+		}
+		result.Result = resultJSON
+	default:
+		return
+	}
+
+	if err := conn.WriteJSON(result); err != nil {
+		log.Printf("failed to send relay result: %s\n", err)
+	}
+}
+
+// registerRelayRoutes wires up the controller-side WebSocket endpoint
+// agents connect to. Only called when RELAY_MODE=controller.
+func registerRelayRoutes(router *mux.Router) {
+	router.HandleFunc("/relay/agent", validateAuth(handleRelayConnect))
+}
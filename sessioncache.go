@@ -0,0 +1,98 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/teslamotors/vehicle-command/pkg/cache"
+)
+
+const sessionCacheFlushInterval = 5 * time.Minute
+
+var sessionCache *cache.SessionCache
+
+// loadSessionCache initializes the process-wide session cache, importing
+// any previously persisted sessions from GetConfig().SessionCachePath so
+// repeat commands can skip the BLE handshake. A missing or unreadable
+// file just starts with an empty cache.
+func loadSessionCache() *cache.SessionCache {
+	path := GetConfig().SessionCachePath
+	if path == "" {
+		return cache.New(0)
+	}
+	imported, err := cache.ImportFromFile(path)
+	if err != nil {
+		log.Printf("No usable session cache at %s, starting fresh: %s\n", path, err)
+		return cache.New(0)
+	}
+	log.Printf("Loaded session cache from %s\n", path)
+	metricCachedSessions.Set(float64(len(imported.Vehicles)))
+	return imported
+}
+
+// startSessionCacheFlusher periodically persists the session cache to
+// disk so sessions survive a restart, writing via a temp file + rename
+// to avoid ever leaving a corrupt file behind.
+func startSessionCacheFlusher() {
+	path := GetConfig().SessionCachePath
+	if path == "" {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		log.Panicf("Could not create session cache directory for %s: %s\n", path, err)
+	}
+	ticker := time.NewTicker(sessionCacheFlushInterval)
+	go func() {
+		for range ticker.C {
+			flushSessionCache()
+		}
+	}()
+}
+
+func flushSessionCache() {
+	path := GetConfig().SessionCachePath
+	if path == "" || sessionCache == nil {
+		return
+	}
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, ".sessions-*.tmp")
+	if err != nil {
+		log.Printf("Failed to flush session cache: %s\n", err)
+		return
+	}
+	tmpPath := tmp.Name()
+	if err := sessionCache.Export(tmp); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		log.Printf("Failed to flush session cache: %s\n", err)
+		return
+	}
+	tmp.Close()
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		log.Printf("Failed to flush session cache: %s\n", err)
+		return
+	}
+	metricCachedSessions.Set(float64(len(sessionCache.Vehicles)))
+}
+
+// handleResetSession drops the cached session for a VIN, forcing the
+// next command to perform a full handshake. Useful when the vehicle's
+// session counter has fallen out of sync with what we cached.
+func handleResetSession(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	vin := vars["vin"]
+	if vin == "" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if sessionCache != nil {
+		sessionCache.Update(vin, nil)
+		flushSessionCache()
+	}
+	sendJSON(w, true)
+}